@@ -1,32 +1,52 @@
 package main
 
 import (
+	"container/heap"
 	"context"
 	"database/sql"
 	"encoding/csv"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"html"
 	"log/slog"
+	"math/rand"
 	"os"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"text/tabwriter"
 	"time"
 
-	_ "github.com/lib/pq" // для PostgreSQL
+	"github.com/robfig/cron/v3"
+
+	_ "github.com/ClickHouse/clickhouse-go/v2" // для ClickHouse
+	_ "github.com/denisenkom/go-mssqldb"       // для MSSQL
+	_ "github.com/go-sql-driver/mysql"         // для MySQL
+	_ "github.com/lib/pq"                      // для PostgreSQL
+	_ "github.com/mattn/go-sqlite3"            // для SQLite
 )
 
 // Конфигурация приложения
 type Config struct {
-	ConnStrings  string        // Строки подключения к БД (через запятую)
-	SQLFile      string        // Имя файла с SQL-запросом
-	SQLQuery     string        // или SQL-запрос
-	Timeout      time.Duration // Таймаут выполнения запроса
-	Limit        int           // Ограничение количества возвращаемых строк
-	Parallel     bool          // Параллельное выполнение запросов
-	OutputFormat string        // Формат вывода результата
-	DebugEnable  bool          // Включить Debug логи
+	ConnStrings    string        // Строки подключения к БД (через запятую)
+	SQLFile        string        // Имя файла с SQL-запросом
+	SQLQuery       string        // или SQL-запрос
+	Timeout        time.Duration // Таймаут выполнения запроса
+	Limit          int           // Ограничение количества возвращаемых строк
+	Parallel       bool          // Параллельное выполнение запросов
+	OutputFormat   string        // Формат вывода результата
+	DebugEnable    bool          // Включить Debug логи
+	ReadOnly       bool          // Выполнять запрос в read-only транзакции
+	Schedule       string        // Cron-выражение для периодического запуска
+	ExpectFile     string        // Путь к CSV-файлу с ожидаемым результатом (golden-file режим)
+	ExpectMode     string        // Режим сравнения golden-file: strict или set
+	MaxConcurrency int           // Максимальное число одновременных подключений в параллельном режиме
+	Retries        int           // Количество повторов при ошибке Ping/запроса
+	RetryBackoff   time.Duration // Базовая задержка экспоненциального backoff между повторами
+	Aggregate      string        // Режим агрегации результата по всем шардам перед выводом (-agg)
 }
 
 const (
@@ -34,19 +54,86 @@ const (
 	DEFAULT_OUTPUT_FORMAT   = TableFormat
 	DEFAULT_TIMEOUT         = time.Second * 5
 	DEFAULT_HEADER_COL_NAME = "DB_№"
+	DEFAULT_RUN_COL_NAME    = "RUN_№"
+	DEFAULT_EXPECT_MODE     = ExpectModeSet
+	DEFAULT_RETRY_BACKOFF   = 200 * time.Millisecond
+)
+
+// Режимы сравнения результата с golden-file в -expect
+const (
+	ExpectModeStrict = "strict" // построчное сравнение с учётом порядка
+	ExpectModeSet    = "set"    // сравнение множеств строк без учёта порядка
 )
 
+func parseExpectMode(s string) (string, error) {
+	s = strings.ToLower(s)
+	switch s {
+	case ExpectModeStrict, ExpectModeSet:
+		return s, nil
+	default:
+		return DEFAULT_EXPECT_MODE, fmt.Errorf("неподдерживаемый режим сравнения -expect-mode")
+	}
+}
+
+// Режимы агрегации результата по всем шардам в -agg: пустая строка - без
+// агрегации (поведение по умолчанию, строки выводятся как есть), union -
+// только уникальные строки, sum/count - группировка по нечисловым колонкам,
+// topk:колонка:N - ограниченная куча из N строк с наибольшим значением колонки
+const (
+	AggUnion      = "union"
+	AggSum        = "sum"
+	AggCount      = "count"
+	aggTopKPrefix = "topk:"
+)
+
+// aggMode - разобранное значение -agg: kind пуст, если агрегация выключена;
+// col и n заполняются только для режима topk
+type aggMode struct {
+	kind string
+	col  string
+	n    int
+}
+
+func parseAggregateMode(s string) (aggMode, error) {
+	if s == "" {
+		return aggMode{}, nil
+	}
+
+	if strings.HasPrefix(s, aggTopKPrefix) {
+		parts := strings.SplitN(s, ":", 3)
+		if len(parts) != 3 || parts[1] == "" {
+			return aggMode{}, fmt.Errorf("неверный формат режима -agg %q, ожидается topk:колонка:N", s)
+		}
+		n, err := strconv.Atoi(parts[2])
+		if err != nil || n <= 0 {
+			return aggMode{}, fmt.Errorf("неверный размер N в режиме -agg %q", s)
+		}
+		return aggMode{kind: "topk", col: parts[1], n: n}, nil
+	}
+
+	switch s {
+	case AggUnion, AggSum, AggCount:
+		return aggMode{kind: s}, nil
+	default:
+		return aggMode{}, fmt.Errorf("неподдерживаемый режим агрегации -agg: %s", s)
+	}
+}
+
 type OutputFormat = string
 
 const (
-	TableFormat OutputFormat = "table"
-	CsvFormat   OutputFormat = "csv"
+	TableFormat    OutputFormat = "table"
+	CsvFormat      OutputFormat = "csv"
+	JsonFormat     OutputFormat = "json"
+	JsonlFormat    OutputFormat = "jsonl"
+	MarkdownFormat OutputFormat = "markdown"
+	HtmlFormat     OutputFormat = "html"
 )
 
 func parseOutputFormat(s string) (OutputFormat, error) {
 	s = strings.ToLower(s)
 	switch s {
-	case TableFormat, CsvFormat:
+	case TableFormat, CsvFormat, JsonFormat, JsonlFormat, MarkdownFormat, HtmlFormat:
 		return s, nil
 	default:
 		return TableFormat, fmt.Errorf("неподдерживаемый формат вывода")
@@ -54,7 +141,7 @@ func parseOutputFormat(s string) (OutputFormat, error) {
 }
 
 func getOutputFormatVariants() []OutputFormat {
-	return []OutputFormat{TableFormat, CsvFormat}
+	return []OutputFormat{TableFormat, CsvFormat, JsonFormat, JsonlFormat, MarkdownFormat, HtmlFormat}
 }
 
 func loadConfig() (*Config, error) {
@@ -82,6 +169,14 @@ func loadConfig() (*Config, error) {
 	)
 	flag.BoolVar(&cfg.Parallel, "p", false, "PARALLEL_MODE: Параллельное выполнение запросов")
 	flag.BoolVar(&cfg.DebugEnable, "v", false, "Влючение debug")
+	flag.BoolVar(&cfg.ReadOnly, "ro", false, "READ_ONLY: Выполнять запрос в read-only транзакции (защита от случайных UPDATE/DELETE)")
+	flag.StringVar(&cfg.Schedule, "schedule", "", "SCHEDULE: Cron-выражение (\"*/5 * * * *\") для периодического запуска запроса")
+	flag.StringVar(&cfg.ExpectFile, "expect", "", "EXPECT_FILE: Путь к CSV-файлу с ожидаемым результатом (golden-file тестирование, вместо вывода сравнивает запрос с фикстурой)")
+	flag.StringVar(&cfg.ExpectMode, "expect-mode", DEFAULT_EXPECT_MODE, fmt.Sprintf("EXPECT_MODE: Режим сравнения с -expect (%s - построчно с учётом порядка, %s - сравнение множеств строк)", ExpectModeStrict, ExpectModeSet))
+	flag.IntVar(&cfg.MaxConcurrency, "j", 0, "MAX_CONCURRENCY: Максимальное число одновременно обрабатываемых подключений в параллельном режиме (0 - без ограничения)")
+	flag.IntVar(&cfg.Retries, "retries", 0, "RETRIES: Количество повторов Ping/запроса к БД при ошибке")
+	flag.DurationVar(&cfg.RetryBackoff, "retry-backoff", DEFAULT_RETRY_BACKOFF, "RETRY_BACKOFF: Базовая задержка экспоненциального backoff между повторами")
+	flag.StringVar(&cfg.Aggregate, "agg", "", fmt.Sprintf("AGGREGATE: Режим агрегации результата по всем шардам перед выводом (%s - уникальные строки, %s/%s - группировка по нечисловым колонкам, \"topk:колонка:N\" - top-N строк по колонке; по умолчанию без агрегации)", AggUnion, AggSum, AggCount))
 
 	// Парсим флаги
 	flag.Parse()
@@ -117,6 +212,52 @@ func loadConfig() (*Config, error) {
 			}
 		}
 	}
+	if !cfg.ReadOnly {
+		if envVal := os.Getenv("READ_ONLY"); envVal != "" {
+			if readOnly, err := strconv.ParseBool(envVal); err == nil {
+				cfg.ReadOnly = readOnly
+			}
+		}
+	}
+	if cfg.Schedule == "" {
+		cfg.Schedule = os.Getenv("SCHEDULE")
+	}
+	if cfg.ExpectFile == "" {
+		cfg.ExpectFile = os.Getenv("EXPECT_FILE")
+	}
+	if cfg.ExpectMode == DEFAULT_EXPECT_MODE {
+		if envVal := os.Getenv("EXPECT_MODE"); envVal != "" {
+			if mode, err := parseExpectMode(envVal); err == nil {
+				cfg.ExpectMode = mode
+			} else {
+				return cfg, err
+			}
+		}
+	}
+	if cfg.MaxConcurrency == 0 {
+		if envVal := os.Getenv("MAX_CONCURRENCY"); envVal != "" {
+			if maxConcurrency, err := strconv.Atoi(envVal); err == nil {
+				cfg.MaxConcurrency = maxConcurrency
+			}
+		}
+	}
+	if cfg.Retries == 0 {
+		if envVal := os.Getenv("RETRIES"); envVal != "" {
+			if retries, err := strconv.Atoi(envVal); err == nil {
+				cfg.Retries = retries
+			}
+		}
+	}
+	if cfg.RetryBackoff == DEFAULT_RETRY_BACKOFF {
+		if envVal := os.Getenv("RETRY_BACKOFF"); envVal != "" {
+			if backoff, err := time.ParseDuration(envVal); err == nil {
+				cfg.RetryBackoff = backoff
+			}
+		}
+	}
+	if cfg.Aggregate == "" {
+		cfg.Aggregate = os.Getenv("AGGREGATE")
+	}
 
 	if cfg.OutputFormat == DEFAULT_OUTPUT_FORMAT {
 		if envVal := os.Getenv("OUTPUT_FORMAT"); envVal != "" {
@@ -138,10 +279,33 @@ func loadConfig() (*Config, error) {
 	if cfg.Limit < 0 {
 		return cfg, fmt.Errorf("лимит не может быть отрицательным")
 	}
+	if cfg.MaxConcurrency < 0 {
+		return cfg, fmt.Errorf("максимальная конкурентность не может быть отрицательной")
+	}
+	if cfg.Retries < 0 {
+		return cfg, fmt.Errorf("количество повторов не может быть отрицательным")
+	}
+	if cfg.RetryBackoff < 0 {
+		return cfg, fmt.Errorf("задержка backoff не может быть отрицательной")
+	}
+	if _, err := parseAggregateMode(cfg.Aggregate); err != nil {
+		return cfg, err
+	}
 
 	return cfg, nil
 }
 
+// connLabel формирует метку подключения для колонки DEFAULT_HEADER_COL_NAME,
+// дополняя порядковый номер именем драйвера, чтобы строки из разных СУБД
+// в одном выводе можно было отличить друг от друга
+func connLabel(i int, connection string) string {
+	driverName, _, err := parseConnString(connection)
+	if err != nil {
+		driverName = "unknown"
+	}
+	return fmt.Sprintf("DB_%d(%s)", i, driverName)
+}
+
 func main() {
 	// Загрузка конфигурации
 	cfg, err := loadConfig()
@@ -160,53 +324,669 @@ func main() {
 	query_args := getQueryArgs()
 	slog.Debug("", "query_args", query_args)
 
+	if cfg.ExpectFile != "" {
+		if runExpect(cfg, query, query_args) {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if cfg.Schedule != "" {
+		runScheduled(cfg, query, query_args)
+		return
+	}
+
+	if runRound(cfg, query, query_args, "") {
+		os.Exit(1)
+	}
+}
+
+// runExpect запускает запрос на всех подключениях и сравнивает результат с
+// golden-file фикстурой вместо вывода на stdout; возвращает true при
+// расхождении (или при ошибке выполнения запроса)
+func runExpect(cfg *Config, query string, query_args []any) bool {
+	expectedHeader, expectedRows, err := loadExpectFixture(cfg.ExpectFile)
+	if err != nil {
+		slog.Error("не удалось прочитать файл с ожидаемым результатом", "file", cfg.ExpectFile, "err", err)
+		return true
+	}
+
+	actualHeader, actualRows, has_errors := collectRows(cfg, query, query_args)
+	if has_errors {
+		return true
+	}
+
+	report, ok := compareRows(cfg.ExpectMode, expectedHeader, actualHeader, expectedRows, actualRows)
+	if !ok {
+		fmt.Fprint(os.Stderr, report)
+		slog.Error("результат запроса не совпадает с ожидаемым", "file", cfg.ExpectFile, "mode", cfg.ExpectMode)
+		return true
+	}
+
+	slog.Info("результат запроса совпадает с ожидаемым", "file", cfg.ExpectFile, "mode", cfg.ExpectMode)
+	return false
+}
+
+// collectRows прогоняет запрос по всем подключениям и собирает заголовок и
+// строки результата в память (в уже отформатированном виде), не передавая
+// их в writer-пайплайн setupOutputWrites — используется golden-file режимом
+// -expect, которому нужен весь результат целиком для сравнения с фикстурой.
+// Если задан -agg, результат предварительно агрегируется через reduceRows —
+// фикстура тогда сравнивается с уже агрегированными строками, а не с сырыми
+// строками по каждому шарду
+func collectRows(cfg *Config, query string, query_args []any) ([]string, [][]string, bool) {
+	header, rows, results := gatherRows(cfg, query, query_args, "")
+
+	if mode, err := parseAggregateMode(cfg.Aggregate); err == nil && mode.kind != "" {
+		header, rows = reduceRows(mode, header, rows)
+	} else {
+		// колонка DEFAULT_HEADER_COL_NAME отражает шард-источник строки и
+		// не входит в фикстуру, которая сравнивается по содержимому запроса
+		shardIdx := columnInfoIndex(header, DEFAULT_HEADER_COL_NAME)
+		header = dropColumnInfo(header, shardIdx)
+		rows = dropColumnValues(rows, shardIdx)
+	}
+
+	formattedRows := make([][]string, len(rows))
+	for i, row := range rows {
+		formattedRow := make([]string, len(row))
+		for j, v := range row {
+			formattedRow[j] = formatSqlValue(v)
+		}
+		formattedRows[i] = formattedRow
+	}
+
+	return headerNames(header), formattedRows, summarizeResults(results)
+}
+
+// gatherRows прогоняет запрос по всем подключениям и собирает заголовок и
+// сырые (ещё типизированные) строки результата в память, вместо потоковой
+// передачи в writer — используется golden-file сравнением (-expect), которому
+// нужен весь результат разом (в т.ч. для агрегации -agg перед сравнением);
+// обычный вывод с -agg идёт через bridgeAggregation, а не через gatherRows
+func gatherRows(cfg *Config, query string, query_args []any, runID string) ([]ColumnInfo, [][]any, []ConnResult) {
+	rows_ch := make(chan []any, DEFAULT_LIMIT)
+	header_ch := make(chan []ColumnInfo, 1)
+
+	var header []ColumnInfo
+	var rows [][]any
+	var collectWg sync.WaitGroup
+	collectWg.Add(1)
+	go func() {
+		defer collectWg.Done()
+		header = <-header_ch
+		for row := range rows_ch {
+			rows = append(rows, row)
+		}
+	}()
+
+	ctx := context.Background()
+	results := runConnections(ctx, cfg, runID, header_ch, rows_ch, query, query_args)
+
+	close(header_ch)
+	close(rows_ch)
+	collectWg.Wait()
+
+	return header, rows, results
+}
+
+// loadExpectFixture читает golden-file фикстуру в формате CSV: первая строка
+// — заголовок колонок, остальные — ожидаемые строки результата
+func loadExpectFixture(path string) ([]string, [][]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	records, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(records) == 0 {
+		return nil, nil, fmt.Errorf("пустой файл с ожидаемым результатом")
+	}
+
+	return records[0], records[1:], nil
+}
+
+// compareRows сравнивает фактический результат с ожидаемой фикстурой в
+// заданном режиме и возвращает текстовый отчёт о расхождениях: в режиме
+// strict - по колонкам каждой строки, в режиме set - только отсутствующие и
+// лишние строки целиком, без разбивки по колонкам
+func compareRows(mode string, expectedHeader, actualHeader []string, expectedRows, actualRows [][]string) (string, bool) {
+	var report strings.Builder
+	ok := true
+
+	if !slices.Equal(expectedHeader, actualHeader) {
+		ok = false
+		fmt.Fprintf(&report, "несовпадение заголовка колонок: ожидалось %v, получено %v\n", expectedHeader, actualHeader)
+	}
+
+	switch mode {
+	case ExpectModeStrict:
+		if len(expectedRows) != len(actualRows) {
+			ok = false
+			fmt.Fprintf(&report, "несовпадение количества строк: ожидалось %d, получено %d\n", len(expectedRows), len(actualRows))
+		}
+
+		n := max(len(expectedRows), len(actualRows))
+		for i := 0; i < n; i++ {
+			var expected, actual []string
+			if i < len(expectedRows) {
+				expected = expectedRows[i]
+			}
+			if i < len(actualRows) {
+				actual = actualRows[i]
+			}
+			for c := range expectedHeader {
+				ev, av := colAt(expected, c), colAt(actual, c)
+				if ev != av {
+					ok = false
+					fmt.Fprintf(&report, "строка %d, колонка %q: ожидалось %q, получено %q\n", i, expectedHeader[c], ev, av)
+				}
+			}
+		}
+
+	case ExpectModeSet:
+		expectedSet := rowSet(expectedRows)
+		actualSet := rowSet(actualRows)
+		for key, count := range expectedSet {
+			if actualSet[key] < count {
+				ok = false
+				fmt.Fprintf(&report, "отсутствует строка (не хватает %d вхождений): %s\n", count-actualSet[key], key)
+			}
+		}
+		for key, count := range actualSet {
+			if expectedSet[key] < count {
+				ok = false
+				fmt.Fprintf(&report, "лишняя строка (%d вхождений сверх ожидаемого): %s\n", count-expectedSet[key], key)
+			}
+		}
+	}
+
+	return report.String(), ok
+}
+
+// colAt безопасно возвращает значение колонки c строки row, либо пустую
+// строку, если строка короче
+func colAt(row []string, c int) string {
+	if c < len(row) {
+		return row[c]
+	}
+	return ""
+}
+
+// rowSet считает количество вхождений каждой строки для сравнения множеств
+func rowSet(rows [][]string) map[string]int {
+	set := make(map[string]int, len(rows))
+	for _, row := range rows {
+		set[strings.Join(row, "\x1f")]++
+	}
+	return set
+}
+
+// columnInfoIndex возвращает индекс колонки с именем name, или -1, если такой
+// колонки нет
+func columnInfoIndex(header []ColumnInfo, name string) int {
+	for i, col := range header {
+		if col.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// dropColumnInfo возвращает header без колонки idx (или сам header, если
+// idx < 0)
+func dropColumnInfo(header []ColumnInfo, idx int) []ColumnInfo {
+	if idx < 0 {
+		return header
+	}
+	out := make([]ColumnInfo, 0, len(header)-1)
+	out = append(out, header[:idx]...)
+	out = append(out, header[idx+1:]...)
+	return out
+}
+
+// dropColumnValues убирает значение колонки idx из каждой строки (или
+// возвращает rows без изменений, если idx < 0)
+func dropColumnValues(rows [][]any, idx int) [][]any {
+	if idx < 0 {
+		return rows
+	}
+	out := make([][]any, len(rows))
+	for i, row := range rows {
+		nr := make([]any, 0, len(row)-1)
+		nr = append(nr, row[:idx]...)
+		nr = append(nr, row[idx+1:]...)
+		out[i] = nr
+	}
+	return out
+}
+
+// valueAt безопасно возвращает значение колонки i строки row, либо nil, если
+// строка короче
+func valueAt(row []any, i int) any {
+	if i < len(row) {
+		return row[i]
+	}
+	return nil
+}
+
+// rowValuesKey формирует ключ для сравнения/группировки строк по значению,
+// отформатированному так же, как для вывода — этого достаточно, чтобы две
+// строки с одинаковым отображаемым содержимым считались одной группой
+func rowValuesKey(values []any) string {
+	parts := make([]string, len(values))
+	for i, v := range values {
+		parts[i] = formatSqlValue(v)
+	}
+	return strings.Join(parts, "\x1f")
+}
+
+// splitByNumeric делит индексы колонок header на нечисловые (ключ
+// группировки для sum/count) и числовые (агрегируемые значения)
+func splitByNumeric(header []ColumnInfo) (groupIdx, numIdx []int) {
+	for i, col := range header {
+		if col.Numeric {
+			numIdx = append(numIdx, i)
+		} else {
+			groupIdx = append(groupIdx, i)
+		}
+	}
+	return
+}
+
+// toFloat64 приводит типизированное значение колонки к float64 для
+// суммирования в режиме -agg sum; нераспознанные типы считаются нулём
+func toFloat64(v any) float64 {
+	switch n := v.(type) {
+	case int64:
+		return float64(n)
+	case int32:
+		return float64(n)
+	case int:
+		return float64(n)
+	case float64:
+		return n
+	case float32:
+		return float64(n)
+	case []byte:
+		f, _ := strconv.ParseFloat(string(n), 64)
+		return f
+	case string:
+		f, _ := strconv.ParseFloat(n, 64)
+		return f
+	default:
+		return 0
+	}
+}
+
+// unionRows оставляет только первую строку из каждой группы одинаковых (по
+// отображаемому значению) строк, сохраняя порядок появления
+func unionRows(rows [][]any) [][]any {
+	seen := make(map[string]bool, len(rows))
+	result := make([][]any, 0, len(rows))
+	for _, row := range rows {
+		key := rowValuesKey(row)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		result = append(result, row)
+	}
+	return result
+}
+
+// sumRows группирует rows по нечисловым колонкам header и суммирует числовые
+func sumRows(header []ColumnInfo, rows [][]any) ([]ColumnInfo, [][]any) {
+	groupIdx, sumIdx := splitByNumeric(header)
+
+	type group struct {
+		key  []any
+		sums []float64
+	}
+	order := make([]string, 0)
+	groups := make(map[string]*group)
+
+	for _, row := range rows {
+		key := make([]any, len(groupIdx))
+		for j, i := range groupIdx {
+			key[j] = valueAt(row, i)
+		}
+		groupKey := rowValuesKey(key)
+
+		g, ok := groups[groupKey]
+		if !ok {
+			g = &group{key: key, sums: make([]float64, len(sumIdx))}
+			groups[groupKey] = g
+			order = append(order, groupKey)
+		}
+		for j, i := range sumIdx {
+			g.sums[j] += toFloat64(valueAt(row, i))
+		}
+	}
+
+	newHeader := make([]ColumnInfo, 0, len(groupIdx)+len(sumIdx))
+	for _, i := range groupIdx {
+		newHeader = append(newHeader, header[i])
+	}
+	for _, i := range sumIdx {
+		newHeader = append(newHeader, header[i])
+	}
+
+	newRows := make([][]any, 0, len(order))
+	for _, k := range order {
+		g := groups[k]
+		row := make([]any, 0, len(newHeader))
+		row = append(row, g.key...)
+		for _, s := range g.sums {
+			row = append(row, s)
+		}
+		newRows = append(newRows, row)
+	}
+
+	return newHeader, newRows
+}
+
+// countRows группирует rows по нечисловым колонкам header и заменяет
+// числовые колонки единственной колонкой "count" с числом строк в группе
+func countRows(header []ColumnInfo, rows [][]any) ([]ColumnInfo, [][]any) {
+	groupIdx, _ := splitByNumeric(header)
+
+	order := make([]string, 0)
+	keys := make(map[string][]any)
+	counts := make(map[string]int64)
+
+	for _, row := range rows {
+		key := make([]any, len(groupIdx))
+		for j, i := range groupIdx {
+			key[j] = valueAt(row, i)
+		}
+		groupKey := rowValuesKey(key)
+		if _, ok := counts[groupKey]; !ok {
+			order = append(order, groupKey)
+			keys[groupKey] = key
+		}
+		counts[groupKey]++
+	}
+
+	newHeader := make([]ColumnInfo, 0, len(groupIdx)+1)
+	for _, i := range groupIdx {
+		newHeader = append(newHeader, header[i])
+	}
+	newHeader = append(newHeader, ColumnInfo{Name: "count", Numeric: true})
+
+	newRows := make([][]any, 0, len(order))
+	for _, k := range order {
+		row := append(append([]any{}, keys[k]...), counts[k])
+		newRows = append(newRows, row)
+	}
+
+	return newHeader, newRows
+}
+
+// topKHeap - мин-куча по значению колонки col, используемая topKRows для
+// отбора N строк с наибольшим значением без сортировки всего набора целиком
+type topKHeap struct {
+	col  int
+	rows [][]any
+}
+
+func (h *topKHeap) Len() int { return len(h.rows) }
+func (h *topKHeap) Less(i, j int) bool {
+	return toFloat64(valueAt(h.rows[i], h.col)) < toFloat64(valueAt(h.rows[j], h.col))
+}
+func (h *topKHeap) Swap(i, j int) { h.rows[i], h.rows[j] = h.rows[j], h.rows[i] }
+func (h *topKHeap) Push(x any)    { h.rows = append(h.rows, x.([]any)) }
+func (h *topKHeap) Pop() any {
+	old := h.rows
+	n := len(old)
+	item := old[n-1]
+	h.rows = old[:n-1]
+	return item
+}
+
+// topKRows отбирает n строк с наибольшим значением колонки col через
+// ограниченную кучу размера n, вместо хранения и сортировки всех строк
+func topKRows(header []ColumnInfo, rows [][]any, col string, n int) ([]ColumnInfo, [][]any) {
+	idx := columnInfoIndex(header, col)
+	if idx < 0 {
+		slog.Error("колонка для -agg topk не найдена", "col", col)
+		return header, rows
+	}
+
+	h := &topKHeap{col: idx}
+	for _, row := range rows {
+		heap.Push(h, row)
+		if h.Len() > n {
+			heap.Pop(h)
+		}
+	}
+
+	result := make([][]any, h.Len())
+	for i := len(result) - 1; i >= 0; i-- {
+		result[i] = heap.Pop(h).([]any)
+	}
+
+	return header, result
+}
+
+// reduceRows применяет режим агрегации -agg к строкам результата по всем
+// шардам сразу: колонка DEFAULT_HEADER_COL_NAME (шард-источник) при этом
+// всегда отбрасывается, т.к. после агрегации строки из разных шардов уже
+// неразличимы
+func reduceRows(mode aggMode, header []ColumnInfo, rows [][]any) ([]ColumnInfo, [][]any) {
+	shardIdx := columnInfoIndex(header, DEFAULT_HEADER_COL_NAME)
+	header = dropColumnInfo(header, shardIdx)
+	rows = dropColumnValues(rows, shardIdx)
+
+	switch mode.kind {
+	case AggUnion:
+		return header, unionRows(rows)
+	case AggSum:
+		return sumRows(header, rows)
+	case AggCount:
+		return countRows(header, rows)
+	case "topk":
+		return topKRows(header, rows, mode.col, mode.n)
+	default:
+		return header, rows
+	}
+}
+
+// formatRow форматирует типизированную строку в строки для writer'ов
+// setupOutputWrites
+func formatRow(row []any) []string {
+	out := make([]string, len(row))
+	for i, v := range row {
+		out[i] = formatSqlValue(v)
+	}
+	return out
+}
+
+// bridgeAggregation переводит сырые типизированные строки из raw_header_ch/
+// raw_rows_ch в уже отформатированные []string для writer'ов
+// setupOutputWrites, попутно применяя режим агрегации -agg. Без агрегации
+// строки идут потоком, не задерживая вывод; union/sum/count/topk должны
+// видеть весь набор целиком, поэтому в этих режимах строки буферизуются в
+// памяти до закрытия raw_rows_ch
+func bridgeAggregation(cfg *Config, raw_header_ch <-chan []ColumnInfo, raw_rows_ch <-chan []any, header_ch chan<- []string, rows_ch chan<- []string) {
+	mode, err := parseAggregateMode(cfg.Aggregate)
+	if err != nil {
+		// cfg уже провалидирован в loadConfig, сюда мы дойти не должны
+		slog.Error("некорректный режим агрегации, агрегация отключена", "agg", cfg.Aggregate, "err", err)
+		mode = aggMode{}
+	}
+
+	header := <-raw_header_ch
+
+	if mode.kind == "" {
+		header_ch <- headerNames(header)
+		for row := range raw_rows_ch {
+			rows_ch <- formatRow(row)
+		}
+		return
+	}
+
+	var rows [][]any
+	for row := range raw_rows_ch {
+		rows = append(rows, row)
+	}
+
+	outHeader, outRows := reduceRows(mode, header, rows)
+
+	header_ch <- headerNames(outHeader)
+	for _, row := range outRows {
+		rows_ch <- formatRow(row)
+	}
+}
+
+// runScheduled держит процесс запущенным и выполняет запрос по cron-расписанию
+// cfg.Schedule против всех подключений на каждом тике, пока процесс не будет
+// остановлен (Ctrl+C / сигнал)
+func runScheduled(cfg *Config, query string, query_args []any) {
+	// SkipIfStillRunning не даёт двум тикам выполняться одновременно: если
+	// runRound предыдущего тика ещё пишет в os.Stdout, когда наступает
+	// следующий, совпадающие по времени запуски будут чередовать строки
+	// вывода друг с другом
+	c := cron.New(cron.WithChain(cron.SkipIfStillRunning(cron.DefaultLogger)))
+
+	var runCounter atomic.Int64
+
+	_, err := c.AddFunc(cfg.Schedule, func() {
+		runID := strconv.FormatInt(runCounter.Add(1), 10)
+		slog.Info("запуск по расписанию", "run_id", runID)
+		if runRound(cfg, query, query_args, runID) {
+			slog.Error("запуск завершился с ошибками", "run_id", runID)
+		}
+	})
+	if err != nil {
+		slog.Error("некорректное cron-выражение", "schedule", cfg.Schedule, "err", err)
+		os.Exit(1)
+	}
+
+	slog.Info("qgun запущен в режиме расписания", "schedule", cfg.Schedule)
+	c.Start()
+
+	select {} // блокируемся навсегда, запуски выполняются по тикам крона
+}
+
+// runRound прогоняет запрос по всем подключениям один раз (один тик
+// расписания или единственный запуск в обычном режиме) и возвращает true,
+// если хотя бы одно подключение завершилось ошибкой. runID пуст вне режима
+// расписания — тогда колонка RUN_№ в вывод не добавляется
+func runRound(cfg *Config, query string, query_args []any, runID string) bool {
 	rows_ch, header_ch, cleanup := setupOutputWrites(cfg, os.Stdout)
 
 	ctx := context.Background()
+	results := runConnections(ctx, cfg, runID, header_ch, rows_ch, query, query_args)
+	cleanup()
+
+	return summarizeResults(results)
+}
 
+// runConnections прогоняет запрос по всем подключениям cfg.ConnStrings, уважая
+// режим -p (последовательно/параллельно), ограничение конкурентности -j и
+// повторы -retries/-retry-backoff, и возвращает результат по каждому
+// подключению в порядке их перечисления в -c
+func runConnections(ctx context.Context, cfg *Config, runID string, header_ch chan<- []ColumnInfo, rows_ch chan<- []any, query string, query_args []any) []ConnResult {
 	// Разбиваем строки подключения
 	connections := strings.Split(cfg.ConnStrings, ",")
-	has_errors := false
+	results := make([]ConnResult, len(connections))
+
+	processOne := func(i int, connection string) {
+		connName := connLabel(i, connection)
+		results[i] = ProcessConnection(ctx, connName, connection, cfg.Limit, cfg.Timeout, cfg.ReadOnly, runID, cfg.Retries, cfg.RetryBackoff, header_ch, rows_ch, query, query_args...)
+		if results[i].Err != nil {
+			slog.Error("Не удалось обработать запрос к БД", "connName", connName, "err", results[i].Err)
+		}
+	}
 
 	if cfg.Parallel {
+		concurrency := cfg.MaxConcurrency
+		if concurrency <= 0 || concurrency > len(connections) {
+			concurrency = len(connections)
+		}
+		sem := make(chan struct{}, concurrency)
+
 		var wg sync.WaitGroup
 		for i, connection := range connections {
 			wg.Add(1)
-			connName := fmt.Sprintf("DB_%d", i)
-			go func() {
+			go func(i int, connection string) {
 				defer wg.Done()
-				err := ProcessConnection(ctx, connName, connection, cfg.Limit, cfg.Timeout, header_ch, rows_ch, query, query_args...)
-				if err != nil {
-					slog.Error("Не удалось обработать запрос к БД", "connName", connName, "err", err)
-					has_errors = true
-				}
-			}()
+				sem <- struct{}{}
+				defer func() { <-sem }()
+				processOne(i, connection)
+			}(i, connection)
 		}
 		slog.Debug("Ожидание обработки всех коннектов")
 		wg.Wait()
-		cleanup()
 	} else {
 		for i, connection := range connections {
-			connName := fmt.Sprintf("DB_%d", i)
-			err := ProcessConnection(ctx, connName, connection, cfg.Limit, cfg.Timeout, header_ch, rows_ch, query, query_args...)
-			if err != nil {
-				slog.Error("Не удалось обработать запрос к БД", "connName", connName, "err", err)
-				has_errors = true
-			}
+			processOne(i, connection)
 		}
-		cleanup()
 	}
 
-	if has_errors {
-		os.Exit(1)
+	return results
+}
+
+// summarizeResults логирует итоги по каждому подключению (строки, время
+// выполнения, класс ошибки) и возвращает true, если хотя бы одно завершилось
+// ошибкой
+func summarizeResults(results []ConnResult) bool {
+	has_errors := false
+	for _, r := range results {
+		if r.Err != nil {
+			has_errors = true
+			slog.Info("итог по подключению", "db", r.ConnName, "rows", r.Rows, "elapsed", r.Elapsed, "error_class", r.Stage, "err", r.Err)
+			continue
+		}
+		slog.Info("итог по подключению", "db", r.ConnName, "rows", r.Rows, "elapsed", r.Elapsed)
 	}
+	return has_errors
+}
+
+// escapeMarkdownCell экранирует "|" и переносы строк в значении ячейки,
+// иначе они ломают разметку таблицы (сдвигают колонки или обрывают строку
+// посреди markdown-документа)
+func escapeMarkdownCell(val string) string {
+	val = strings.ReplaceAll(val, "|", "\\|")
+	val = strings.ReplaceAll(val, "\r\n", " ")
+	val = strings.ReplaceAll(val, "\n", " ")
+	val = strings.ReplaceAll(val, "\r", " ")
+	return val
+}
 
+// rowToObject сопоставляет строку значений заголовку колонок, чтобы
+// JSON/JSONL-вывод отдавал объекты вида {"col": "value"} вместо массивов
+func rowToObject(header []string, row []string) map[string]string {
+	obj := make(map[string]string, len(header))
+	for i, col := range header {
+		if i < len(row) {
+			obj[col] = row[i]
+		}
+	}
+	return obj
 }
 
-func setupOutputWrites(cfg *Config, output *os.File) (chan<- []string, chan<- []string, func()) {
+func setupOutputWrites(cfg *Config, output *os.File) (chan<- []any, chan<- []ColumnInfo, func()) {
+	raw_header_ch := make(chan []ColumnInfo, 1)
+	raw_rows_ch := make(chan []any, DEFAULT_LIMIT)
+
 	rows_ch := make(chan []string, DEFAULT_LIMIT)
 	header_ch := make(chan []string, 1)
 
+	var bridgeWg sync.WaitGroup
+	bridgeWg.Add(1)
+	go func() {
+		defer bridgeWg.Done()
+		defer close(header_ch)
+		defer close(rows_ch)
+		bridgeAggregation(cfg, raw_header_ch, raw_rows_ch, header_ch, rows_ch)
+	}()
+
 	var wg sync.WaitGroup
 	wg.Add(1)
 
@@ -263,21 +1043,130 @@ func setupOutputWrites(cfg *Config, output *os.File) (chan<- []string, chan<- []
 			defer cw.Flush()
 			processChannels(cw.Write)
 		}()
+
+	case JsonFormat:
+		slog.Debug("running JsonWriter export in backgroud")
+		var header []string
+		first := true
+		writeRow := func(row []string) error {
+			if header == nil {
+				header = row
+				return nil
+			}
+			obj := rowToObject(header, row)
+			b, err := json.Marshal(obj)
+			if err != nil {
+				return err
+			}
+			if !first {
+				if _, err := fmt.Fprint(output, ","); err != nil {
+					return err
+				}
+			}
+			first = false
+			_, err = output.Write(b)
+			return err
+		}
+
+		go func() {
+			defer wg.Done()
+			fmt.Fprint(output, "[")
+			defer fmt.Fprintln(output, "]")
+			processChannels(writeRow)
+		}()
+
+	case JsonlFormat:
+		slog.Debug("running JsonlWriter export in backgroud")
+		var header []string
+		enc := json.NewEncoder(output)
+		writeRow := func(row []string) error {
+			if header == nil {
+				header = row
+				return nil
+			}
+			return enc.Encode(rowToObject(header, row))
+		}
+
+		go func() {
+			defer wg.Done()
+			processChannels(writeRow)
+		}()
+
+	case MarkdownFormat:
+		slog.Debug("running MarkdownWriter export in backgroud")
+		var header []string
+		writeRow := func(row []string) error {
+			cells := make([]string, len(row))
+			for i, val := range row {
+				cells[i] = escapeMarkdownCell(val)
+			}
+			_, err := fmt.Fprintf(output, "| %s |\n", strings.Join(cells, " | "))
+			if err != nil {
+				return err
+			}
+			if header == nil {
+				header = row
+				sep := make([]string, len(row))
+				for i := range sep {
+					sep[i] = "---"
+				}
+				_, err = fmt.Fprintf(output, "| %s |\n", strings.Join(sep, " | "))
+			}
+			return err
+		}
+
+		go func() {
+			defer wg.Done()
+			processChannels(writeRow)
+		}()
+
+	case HtmlFormat:
+		slog.Debug("running HtmlWriter export in backgroud")
+		writeRow := func(tag string) func([]string) error {
+			return func(row []string) error {
+				cells := make([]string, len(row))
+				for i, val := range row {
+					cells[i] = fmt.Sprintf("<%[1]s>%s</%[1]s>", tag, html.EscapeString(val))
+				}
+				_, err := fmt.Fprintf(output, "<tr>%s</tr>\n", strings.Join(cells, ""))
+				return err
+			}
+		}
+		writeHeaderRow := writeRow("th")
+		writeDataRow := writeRow("td")
+		first := true
+		writeHtmlRow := func(row []string) error {
+			if first {
+				first = false
+				return writeHeaderRow(row)
+			}
+			return writeDataRow(row)
+		}
+
+		go func() {
+			defer wg.Done()
+			fmt.Fprintln(output, "<table>")
+			defer fmt.Fprintln(output, "</table>")
+			processChannels(writeHtmlRow)
+		}()
+
 	default:
 		panic("not implemented case of cfg.OutputFormat")
 	}
 
 	cleanup := func() {
 		slog.Debug("close headers chan")
-		close(header_ch)
+		close(raw_header_ch)
 		slog.Debug("close rows chan")
-		close(rows_ch)
+		close(raw_rows_ch)
+		slog.Debug("wait aggregation bridge")
+		bridgeWg.Wait()
 		slog.Debug("wait writer")
 		wg.Wait()
 		slog.Debug("writes done")
 	}
 
-	return rows_ch, header_ch, cleanup
+	return raw_rows_ch, raw_header_ch, cleanup
 }
 
 func getQueryArgs() []any {
@@ -310,28 +1199,164 @@ func getQuery(cfg *Config) string {
 	return query
 }
 
-func ProcessConnection(ctx context.Context, connName string, connection string, limit int, timeout time.Duration, header_channel chan<- []string, rows_channel chan<- []string, query string, query_args ...any) error {
-	db, err := sql.Open("postgres", connection)
+// driverPrefixes сопоставляет префикс строки подключения (схему URL) с именем
+// драйвера database/sql, зарегистрированным соответствующим пакетом
+var driverPrefixes = map[string]string{
+	"postgres":   "postgres",
+	"postgresql": "postgres",
+	"mysql":      "mysql",
+	"sqlite":     "sqlite3",
+	"sqlite3":    "sqlite3",
+	"mssql":      "mssql",
+	"sqlserver":  "mssql",
+	"clickhouse": "clickhouse",
+}
+
+// parseConnString определяет драйвер БД и DSN по префиксу строки подключения
+// (например, "mysql://...", "sqlite:///path/db"). Если префикс не указан,
+// используется postgres для обратной совместимости со старыми конфигами.
+func parseConnString(conn string) (driver string, dsn string, err error) {
+	scheme, rest, ok := strings.Cut(conn, "://")
+	if !ok {
+		return "postgres", conn, nil
+	}
+
+	driver, ok = driverPrefixes[strings.ToLower(scheme)]
+	if !ok {
+		return "", "", fmt.Errorf("неизвестный драйвер БД: %s", scheme)
+	}
+
+	switch driver {
+	case "postgres", "clickhouse":
+		// эти драйверы ожидают полную строку подключения вместе со схемой
+		dsn = conn
+	case "mssql":
+		// msdsn.Parse использует URL-парсинг, только если строка начинается
+		// именно с "sqlserver://" (схема "mssql://" не распознаётся) — без
+		// этого он молча откатывается на устаревший формат "key=value;..."
+		// и подключается с пустыми User/Password/Database без единой ошибки
+		dsn = "sqlserver://" + rest
+	default:
+		dsn = rest
+	}
+
+	return driver, dsn, nil
+}
+
+// Querier объединяет *sql.DB и *sql.Tx, позволяя NewLimitedQueryContext
+// выполнять запрос как напрямую через соединение, так и внутри транзакции
+type Querier interface {
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+}
+
+// isolationForDriver возвращает уровень изоляции read-only транзакции для
+// данного драйвера: PostgreSQL поддерживает Serializable без потери
+// параллелизма на чтении, остальным СУБД достаточно RepeatableRead
+func isolationForDriver(driverName string) sql.IsolationLevel {
+	if driverName == "postgres" {
+		return sql.LevelSerializable
+	}
+	return sql.LevelRepeatableRead
+}
+
+// ConnResult — итог обработки одного подключения: сколько строк вернул
+// запрос, сколько это заняло времени, и (если была ошибка) на каком этапе
+// она произошла — Stage служит классом ошибки для сводки
+type ConnResult struct {
+	ConnName string
+	Rows     int
+	Elapsed  time.Duration
+	Stage    string
+	Err      error
+}
+
+// withRetry повторяет fn до retries раз с экспоненциальной задержкой и
+// джиттером между попытками, прекращая досрочно при отмене ctx. retries <= 0
+// отключает повторы — fn выполняется один раз
+func withRetry(ctx context.Context, retries int, backoff time.Duration, fn func() error) error {
+	var err error
+	for attempt := 0; ; attempt++ {
+		err = fn()
+		if err == nil || attempt >= retries {
+			return err
+		}
+
+		wait := backoff*time.Duration(1<<attempt) + time.Duration(rand.Int63n(int64(backoff)+1))
+		slog.Debug("повтор после ошибки", "attempt", attempt+1, "wait", wait, "err", err)
+
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func ProcessConnection(ctx context.Context, connName string, connection string, limit int, timeout time.Duration, readOnly bool, runID string, retries int, retryBackoff time.Duration, header_channel chan<- []ColumnInfo, rows_channel chan<- []any, query string, query_args ...any) ConnResult {
+	start := time.Now()
+	result := ConnResult{ConnName: connName}
+
+	driverName, dsn, err := parseConnString(connection)
 	if err != nil {
-		return fmt.Errorf("ошибка создания подключения к БД: %w", err)
+		result.Stage = "parse"
+		result.Err = fmt.Errorf("ошибка разбора строки подключения: %w", err)
+		result.Elapsed = time.Since(start)
+		return result
 	}
-	defer db.Close()
 
-	err = db.Ping()
+	db, err := sql.Open(driverName, dsn)
 	if err != nil {
-		return fmt.Errorf("ошибка подключения к БД: %w", err)
+		result.Stage = "connect"
+		result.Err = fmt.Errorf("ошибка создания подключения к БД: %w", err)
+		result.Elapsed = time.Since(start)
+		return result
 	}
+	defer db.Close()
 
 	ctx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
 
-	qc, err := NewLimitedQueryContext(ctx, db, limit, query, query_args...)
+	err = withRetry(ctx, retries, retryBackoff, func() error {
+		return db.PingContext(ctx)
+	})
+	if err != nil {
+		result.Stage = "connect"
+		result.Err = fmt.Errorf("ошибка подключения к БД: %w", err)
+		result.Elapsed = time.Since(start)
+		return result
+	}
+
+	var querier Querier = db
+	if readOnly {
+		tx, err := db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true, Isolation: isolationForDriver(driverName)})
+		if err != nil {
+			result.Stage = "readonly-tx"
+			result.Err = fmt.Errorf("ошибка начала read-only транзакции: %w", err)
+			result.Elapsed = time.Since(start)
+			return result
+		}
+		defer tx.Rollback()
+		querier = tx
+	}
+
+	var qc *LimitedQueryContext
+	err = withRetry(ctx, retries, retryBackoff, func() error {
+		var qerr error
+		qc, qerr = NewLimitedQueryContext(ctx, querier, limit, query, query_args...)
+		return qerr
+	})
 	if err != nil {
-		return fmt.Errorf("ошибка выполнения запроса к бд QUERY(%v) ARGS(%v): %w", query, query_args, err)
+		result.Stage = "query"
+		result.Err = fmt.Errorf("ошибка выполнения запроса к бд QUERY(%v) ARGS(%v): %w", query, query_args, err)
+		result.Elapsed = time.Since(start)
+		return result
 	}
 	defer qc.Close()
 
-	header := append([]string{DEFAULT_HEADER_COL_NAME}, qc.Columns()...)
+	header := append([]ColumnInfo{{Name: DEFAULT_HEADER_COL_NAME}}, qc.Columns()...)
+	if runID != "" {
+		header = append([]ColumnInfo{{Name: DEFAULT_RUN_COL_NAME}}, header...)
+	}
 
 	select {
 	case header_channel <- header:
@@ -344,26 +1369,79 @@ func ProcessConnection(ctx context.Context, connName string, connection string,
 	for qc.Next() {
 		row, err := qc.Scan()
 		if err != nil {
-			return fmt.Errorf("ошибка сканирования строки: %w", err)
+			result.Stage = "scan"
+			result.Err = fmt.Errorf("ошибка сканирования строки: %w", err)
+			result.Elapsed = time.Since(start)
+			return result
 		}
 
-		row = append([]string{connName}, row...)
+		row = append([]any{connName}, row...)
+		if runID != "" {
+			row = append([]any{runID}, row...)
+		}
 
 		rows_channel <- row
+		result.Rows++
 
 	}
 	if err := qc.Err(); err != nil {
-		return fmt.Errorf("ошибка при итерации: %w", err)
+		result.Stage = "iterate"
+		result.Err = fmt.Errorf("ошибка при итерации: %w", err)
+		result.Elapsed = time.Since(start)
+		return result
 	}
 	slog.DebugContext(ctx, "process rows comlite", "connName", connName)
-	return nil
+
+	result.Elapsed = time.Since(start)
+	return result
+}
+
+// ColumnInfo описывает колонку результата: имя и является ли её тип
+// числовым. Numeric определяет поведение -agg: нечисловые колонки образуют
+// ключ группировки в sum/count, числовые - агрегируются
+type ColumnInfo struct {
+	Name    string
+	Numeric bool
+}
+
+// headerNames возвращает только имена колонок, отбрасывая признак Numeric -
+// этого достаточно для writer'ов, которым нужны лишь заголовки столбцов
+func headerNames(header []ColumnInfo) []string {
+	names := make([]string, len(header))
+	for i, col := range header {
+		names[i] = col.Name
+	}
+	return names
+}
+
+// numericDatabaseTypeSubstrings - подстроки ColumnType.DatabaseTypeName(),
+// встречающиеся в именах числовых типов у поддерживаемых драйверов (INT/
+// INTEGER/BIGINT/SMALLINT/TINYINT, FLOAT/DOUBLE/REAL, DECIMAL/NUMERIC/MONEY
+// и их аналоги)
+var numericDatabaseTypeSubstrings = []string{
+	"INT", "FLOAT", "DOUBLE", "DECIMAL", "NUMERIC", "REAL", "MONEY", "SERIAL",
+}
+
+// isNumericColumnType определяет, является ли колонка числовой, по имени её
+// SQL-типа. ScanType().Kind() для этого не годится: у nullable-колонок
+// драйверы возвращают sql.NullInt64/NullFloat64 (reflect.Struct, не Int64/
+// Float64), а DECIMAL/NUMERIC у Postgres и MySQL зачастую вовсе не
+// сообщают числовой Go-тип через ScanType
+func isNumericColumnType(ct *sql.ColumnType) bool {
+	name := strings.ToUpper(ct.DatabaseTypeName())
+	for _, t := range numericDatabaseTypeSubstrings {
+		if strings.Contains(name, t) {
+			return true
+		}
+	}
+	return false
 }
 
 type LimitedQueryContext struct {
 	rowCounter     int
 	rowLimit       int
 	rows           *sql.Rows
-	col_names      []string
+	columns        []ColumnInfo
 	buf_values     []any
 	buf_valuesPtrs []any
 }
@@ -372,7 +1450,7 @@ func (q *LimitedQueryContext) Close() (_ error) {
 	return q.rows.Close()
 }
 
-func NewLimitedQueryContext(ctx context.Context, db *sql.DB, limit int, query string, args ...any) (*LimitedQueryContext, error) {
+func NewLimitedQueryContext(ctx context.Context, db Querier, limit int, query string, args ...any) (*LimitedQueryContext, error) {
 	rows, err := db.QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, err
@@ -385,18 +1463,18 @@ func NewLimitedQueryContext(ctx context.Context, db *sql.DB, limit int, query st
 
 	values := make([]any, len(colTypes))
 	valuesRtrs := make([]any, len(colTypes))
-	col_names := make([]string, len(colTypes))
+	columns := make([]ColumnInfo, len(colTypes))
 
 	for i, ct := range colTypes {
 		valuesRtrs[i] = &values[i]
-		col_names[i] = ct.Name()
+		columns[i] = ColumnInfo{Name: ct.Name(), Numeric: isNumericColumnType(ct)}
 	}
 
 	result := LimitedQueryContext{
 		rowCounter:     0,
 		rowLimit:       limit,
 		rows:           rows,
-		col_names:      col_names,
+		columns:        columns,
 		buf_values:     values,
 		buf_valuesPtrs: valuesRtrs,
 	}
@@ -408,6 +1486,9 @@ func (q *LimitedQueryContext) Next() bool {
 	return q.rows.Next()
 }
 
+// formatSqlValue форматирует типизированное значение колонки в строку для
+// табличного/CSV/JSON и т.п. вывода - применяется только на этапе записи
+// результата, чтобы агрегация (-agg) могла работать с исходными типами
 func formatSqlValue(val any) string {
 	var strVal string
 	switch v := val.(type) {
@@ -421,7 +1502,10 @@ func formatSqlValue(val any) string {
 	return strVal
 }
 
-func (q *LimitedQueryContext) Scan() ([]string, error) {
+// Scan возвращает сырые типизированные значения текущей строки (не
+// отформатированные в строки), чтобы агрегация -agg могла оперировать
+// числами напрямую, не выполняя обратный парсинг текста
+func (q *LimitedQueryContext) Scan() ([]any, error) {
 	if q.rowLimit > 0 && q.rowCounter >= q.rowLimit {
 		return nil, NewLimitReachedErr(q.rowLimit)
 	}
@@ -429,10 +1513,17 @@ func (q *LimitedQueryContext) Scan() ([]string, error) {
 		return nil, err
 	}
 
-	row := make([]string, len(q.buf_values)+1)
-
+	row := make([]any, len(q.buf_values))
 	for i, v := range q.buf_values {
-		row[i] = formatSqlValue(v)
+		// rows.Scan переиспользует буфер []byte между вызовами, поэтому
+		// значение нужно скопировать, иначе следующая строка его перезапишет
+		if b, ok := v.([]byte); ok {
+			cp := make([]byte, len(b))
+			copy(cp, b)
+			row[i] = cp
+		} else {
+			row[i] = v
+		}
 	}
 
 	q.rowCounter += 1
@@ -444,8 +1535,8 @@ func (q *LimitedQueryContext) Err() error {
 	return q.rows.Err()
 }
 
-func (q *LimitedQueryContext) Columns() []string {
-	return q.col_names
+func (q *LimitedQueryContext) Columns() []ColumnInfo {
+	return q.columns
 }
 
 type LimitReachedErr struct {
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"database/sql"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func TestIsNumericColumnType(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("sql.Open: %v", err)
+	}
+	defer db.Close()
+
+	_, err = db.Exec(`
+		CREATE TABLE t (
+			id INTEGER,
+			amount DECIMAL(10,2),
+			price REAL,
+			qty NUMERIC,
+			name TEXT,
+			flag BOOLEAN
+		)
+	`)
+	if err != nil {
+		t.Fatalf("create table: %v", err)
+	}
+	_, err = db.Exec(`INSERT INTO t VALUES (1, 9.5, 1.1, 3, 'x', NULL)`)
+	if err != nil {
+		t.Fatalf("insert: %v", err)
+	}
+
+	rows, err := db.Query(`SELECT id, amount, price, qty, name, flag FROM t`)
+	if err != nil {
+		t.Fatalf("query: %v", err)
+	}
+	defer rows.Close()
+
+	cols, err := rows.ColumnTypes()
+	if err != nil {
+		t.Fatalf("column types: %v", err)
+	}
+
+	want := map[string]bool{
+		"id":     true,
+		"amount": true,
+		"price":  true,
+		"qty":    true,
+		"name":   false,
+		"flag":   false,
+	}
+	for _, ct := range cols {
+		got := isNumericColumnType(ct)
+		if got != want[ct.Name()] {
+			t.Errorf("isNumericColumnType(%s) = %v, хотели %v (DatabaseTypeName=%s)", ct.Name(), got, want[ct.Name()], ct.DatabaseTypeName())
+		}
+	}
+}
+
+func TestSumRows(t *testing.T) {
+	header := []ColumnInfo{
+		{Name: "group", Numeric: false},
+		{Name: "amount", Numeric: true},
+	}
+	rows := [][]any{
+		{"a", int64(1)},
+		{"a", int64(2)},
+		{"b", int64(5)},
+	}
+
+	newHeader, newRows := sumRows(header, rows)
+
+	if len(newHeader) != 2 || newHeader[0].Name != "group" || newHeader[1].Name != "amount" {
+		t.Fatalf("неожиданный header: %+v", newHeader)
+	}
+
+	sums := map[string]float64{}
+	for _, r := range newRows {
+		sums[r[0].(string)] = r[1].(float64)
+	}
+	if sums["a"] != 3 {
+		t.Errorf("sum для группы a = %v, хотели 3", sums["a"])
+	}
+	if sums["b"] != 5 {
+		t.Errorf("sum для группы b = %v, хотели 5", sums["b"])
+	}
+}
+
+func TestCountRows(t *testing.T) {
+	header := []ColumnInfo{
+		{Name: "group", Numeric: false},
+		{Name: "amount", Numeric: true},
+	}
+	rows := [][]any{
+		{"a", int64(1)},
+		{"a", int64(2)},
+		{"b", int64(5)},
+	}
+
+	newHeader, newRows := countRows(header, rows)
+
+	if len(newHeader) != 2 || newHeader[1].Name != "count" {
+		t.Fatalf("неожиданный header: %+v", newHeader)
+	}
+
+	counts := map[string]int64{}
+	for _, r := range newRows {
+		counts[r[0].(string)] = r[1].(int64)
+	}
+	if counts["a"] != 2 {
+		t.Errorf("count для группы a = %v, хотели 2", counts["a"])
+	}
+	if counts["b"] != 1 {
+		t.Errorf("count для группы b = %v, хотели 1", counts["b"])
+	}
+}
+
+func TestTopKRows(t *testing.T) {
+	header := []ColumnInfo{
+		{Name: "name", Numeric: false},
+		{Name: "score", Numeric: true},
+	}
+	rows := [][]any{
+		{"a", int64(1)},
+		{"b", int64(5)},
+		{"c", int64(3)},
+		{"d", int64(4)},
+	}
+
+	_, top := topKRows(header, rows, "score", 2)
+
+	if len(top) != 2 {
+		t.Fatalf("topKRows вернул %d строк, хотели 2", len(top))
+	}
+	names := map[string]bool{top[0][0].(string): true, top[1][0].(string): true}
+	if !names["b"] || !names["d"] {
+		t.Errorf("topKRows = %v, хотели строки b и d (наибольший score)", top)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import "testing"
+
+func TestCompareRowsStrict(t *testing.T) {
+	header := []string{"id", "name"}
+
+	t.Run("совпадающие строки в том же порядке", func(t *testing.T) {
+		rows := [][]string{{"1", "a"}, {"2", "b"}}
+		report, ok := compareRows(ExpectModeStrict, header, header, rows, rows)
+		if !ok {
+			t.Errorf("ожидалось совпадение, отчёт: %s", report)
+		}
+	})
+
+	t.Run("разный порядок строк считается расхождением", func(t *testing.T) {
+		expected := [][]string{{"1", "a"}, {"2", "b"}}
+		actual := [][]string{{"2", "b"}, {"1", "a"}}
+		_, ok := compareRows(ExpectModeStrict, header, header, expected, actual)
+		if ok {
+			t.Errorf("ожидалось расхождение из-за порядка строк")
+		}
+	})
+
+	t.Run("несовпадение количества строк", func(t *testing.T) {
+		expected := [][]string{{"1", "a"}, {"2", "b"}}
+		actual := [][]string{{"1", "a"}}
+		report, ok := compareRows(ExpectModeStrict, header, header, expected, actual)
+		if ok {
+			t.Errorf("ожидалось расхождение, отчёт: %s", report)
+		}
+	})
+
+	t.Run("несовпадение заголовка", func(t *testing.T) {
+		rows := [][]string{{"1", "a"}}
+		_, ok := compareRows(ExpectModeStrict, header, []string{"id", "title"}, rows, rows)
+		if ok {
+			t.Errorf("ожидалось расхождение из-за заголовка")
+		}
+	})
+}
+
+func TestCompareRowsSet(t *testing.T) {
+	header := []string{"id", "name"}
+
+	t.Run("совпадающий набор в разном порядке", func(t *testing.T) {
+		expected := [][]string{{"1", "a"}, {"2", "b"}}
+		actual := [][]string{{"2", "b"}, {"1", "a"}}
+		report, ok := compareRows(ExpectModeSet, header, header, expected, actual)
+		if !ok {
+			t.Errorf("ожидалось совпадение множеств, отчёт: %s", report)
+		}
+	})
+
+	t.Run("отсутствующая строка", func(t *testing.T) {
+		expected := [][]string{{"1", "a"}, {"2", "b"}}
+		actual := [][]string{{"1", "a"}}
+		_, ok := compareRows(ExpectModeSet, header, header, expected, actual)
+		if ok {
+			t.Errorf("ожидалось расхождение из-за отсутствующей строки")
+		}
+	})
+
+	t.Run("лишняя строка", func(t *testing.T) {
+		expected := [][]string{{"1", "a"}}
+		actual := [][]string{{"1", "a"}, {"2", "b"}}
+		_, ok := compareRows(ExpectModeSet, header, header, expected, actual)
+		if ok {
+			t.Errorf("ожидалось расхождение из-за лишней строки")
+		}
+	})
+}